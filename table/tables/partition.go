@@ -16,18 +16,23 @@ package tables
 import (
 	"bytes"
 	"fmt"
+	"hash/crc32"
+	"math"
 	"sort"
 	"strings"
 
 	"github.com/juju/errors"
+	"github.com/pingcap/tidb/ast"
 	"github.com/pingcap/tidb/expression"
 	"github.com/pingcap/tidb/kv"
 	"github.com/pingcap/tidb/model"
 	"github.com/pingcap/tidb/sessionctx"
+	"github.com/pingcap/tidb/sessionctx/stmtctx"
 	"github.com/pingcap/tidb/table"
 	"github.com/pingcap/tidb/tablecodec"
 	"github.com/pingcap/tidb/types"
 	"github.com/pingcap/tidb/util/chunk"
+	"github.com/pingcap/tidb/util/codec"
 	"github.com/pingcap/tidb/util/mock"
 	log "github.com/sirupsen/logrus"
 )
@@ -103,11 +108,131 @@ func newPartitionedTable(tbl *Table, tblInfo *model.TableInfo) (table.Table, err
 type PartitionExpr struct {
 	Ranges      []expression.Expression
 	UpperBounds []expression.Expression
+
+	// List holds the lookup structures for PARTITION BY LIST and PARTITION BY
+	// LIST COLUMNS tables. It is nil unless the table uses one of those two
+	// strategies.
+	List *ForListPruning
+
+	// Hash holds the lookup structures for PARTITION BY HASH and PARTITION
+	// BY KEY tables. It is nil unless the table uses one of those two
+	// strategies.
+	Hash *ForHashPruning
+}
+
+// ForHashPruning holds everything needed to locate a partition for
+// PARTITION BY HASH and PARTITION BY KEY tables. Both strategies spread rows
+// across a fixed number of buckets by hashing, so range filters give no
+// bucket information; only equality/IN filters on a HASH(bare column) table
+// narrow the buckets, and every other case enumerates every bucket.
+type ForHashPruning struct {
+	// IsKey reports whether the table uses PARTITION BY KEY rather than
+	// PARTITION BY HASH. KEY hashes the encoded key columns (see
+	// keyPartitionHash) instead of evaluating a single int expression.
+	IsKey bool
+
+	// HashExpr is the parsed HASH(expr); nil when IsKey is true.
+	HashExpr expression.Expression
+
+	// KeyColumns are the evaluated KEY(col, ...) columns; nil when IsKey is
+	// false.
+	KeyColumns []expression.Expression
+
+	// NumBuckets is the PARTITIONS n clause; buckets are numbered 0..NumBuckets-1
+	// and map 1:1 onto pi.Definitions in order.
+	NumBuckets int
+
+	// bareColName and bareColIdx identify HashExpr's column when HashExpr is
+	// exactly a bare column reference (the common "PARTITION BY HASH(col)"
+	// case, as opposed to an expression like HASH(col + 1)): bareColName is
+	// the column's name, lower-cased, and bareColIdx its offset within the
+	// table's full column list. bareColName is empty when HashExpr is not a
+	// bare column, or when IsKey is true. PrunePartitions uses these to
+	// evaluate HashExpr against a hypothetical equality value without
+	// needing a real row.
+	bareColName string
+	bareColIdx  int
+	// rowWidth is the number of columns in the table's row layout, i.e. the
+	// width the prune-time synthetic row must have so bareColIdx lines up.
+	rowWidth int
+}
+
+// ForListPruning holds everything needed to locate and prune partitions for
+// PARTITION BY LIST (scalar) and PARTITION BY LIST COLUMNS (tuple) tables.
+// Unlike RANGE, there is no monotonic order to binary search over, so
+// locating a partition is a single lookup into valueMap instead.
+type ForListPruning struct {
+	// LocateExprs evaluates the partitioning columns for a given row: one
+	// expression for scalar LIST, one per column for LIST COLUMNS.
+	LocateExprs []expression.Expression
+
+	// PruneExprs are per-partition "(expr) IN (v1, v2, ...)" expressions,
+	// mirroring PartitionExpr.Ranges, so the planner can prune LIST
+	// partitions the same way it prunes RANGE partitions.
+	PruneExprs []expression.Expression
+
+	// valueMap maps an encoded value (or tuple, for LIST COLUMNS) to the
+	// owning partition's ID.
+	valueMap map[string]int64
+	// nullPartitionID is the ID of the partition whose value list contains
+	// NULL, or -1 if none of the partitions accept NULL.
+	nullPartitionID int64
 }
 
 func generatePartitionExpr(tblInfo *model.TableInfo) (*PartitionExpr, error) {
 	// The caller should assure partition info is not nil.
 	pi := tblInfo.GetPartitionInfo()
+	switch pi.Type {
+	case model.PartitionTypeList:
+		return generateListPartitionExpr(tblInfo, pi)
+	case model.PartitionTypeHash, model.PartitionTypeKey:
+		return generateHashPartitionExpr(tblInfo, pi)
+	default:
+		return generateRangePartitionExpr(tblInfo, pi)
+	}
+}
+
+// generateHashPartitionExpr parses the single HASH(expr) expression, or the
+// KEY(col, ...) column list, once up front; locatePartition re-evaluates it
+// per row instead of building one expression per partition the way RANGE
+// does, since every partition shares the same hash/mod computation.
+func generateHashPartitionExpr(tblInfo *model.TableInfo, pi *model.PartitionInfo) (*PartitionExpr, error) {
+	ctx := mock.NewContext()
+	isKey := pi.Type == model.PartitionTypeKey
+	hash := &ForHashPruning{
+		IsKey:      isKey,
+		NumBuckets: len(pi.Definitions),
+	}
+	if isKey {
+		hash.KeyColumns = make([]expression.Expression, 0, len(pi.Columns))
+		for _, col := range pi.Columns {
+			expr, err := expression.ParseSimpleExprWithTableInfo(ctx, col.O, tblInfo)
+			if err != nil {
+				log.Error("wrong table partition expression:", errors.ErrorStack(err), col.O)
+				return nil, errors.Trace(err)
+			}
+			hash.KeyColumns = append(hash.KeyColumns, expr)
+		}
+	} else {
+		expr, err := expression.ParseSimpleExprWithTableInfo(ctx, pi.Expr, tblInfo)
+		if err != nil {
+			log.Error("wrong table partition expression:", errors.ErrorStack(err), pi.Expr)
+			return nil, errors.Trace(err)
+		}
+		hash.HashExpr = expr
+		if col, ok := expr.(*expression.Column); ok {
+			hash.bareColName = col.ColName.L
+			hash.bareColIdx = col.Index
+			hash.rowWidth = len(tblInfo.Columns)
+		}
+	}
+	return &PartitionExpr{Hash: hash}, nil
+}
+
+func generateRangePartitionExpr(tblInfo *model.TableInfo, pi *model.PartitionInfo) (*PartitionExpr, error) {
+	if len(pi.Columns) > 0 {
+		return generateRangeColumnsPartitionExpr(tblInfo, pi)
+	}
 	ctx := mock.NewContext()
 	partitionPruneExprs := make([]expression.Expression, 0, len(pi.Definitions))
 	locateExprs := make([]expression.Expression, 0, len(pi.Definitions))
@@ -146,6 +271,279 @@ func generatePartitionExpr(tblInfo *model.TableInfo) (*PartitionExpr, error) {
 	}, nil
 }
 
+// generateRangeColumnsPartitionExpr builds PartitionExpr for
+// PARTITION BY RANGE COLUMNS(c1, c2, ...). Unlike plain RANGE, each
+// partition's bound is a tuple, so the locating expression is a lexicographic
+// row-wise comparison over the full tuple rather than a single "(expr) <
+// (bound)" check.
+func generateRangeColumnsPartitionExpr(tblInfo *model.TableInfo, pi *model.PartitionInfo) (*PartitionExpr, error) {
+	if err := validateRangeColumnsDefinitions(pi); err != nil {
+		return nil, errors.Trace(err)
+	}
+	ctx := mock.NewContext()
+	cols := make([]string, 0, len(pi.Columns))
+	for _, c := range pi.Columns {
+		cols = append(cols, c.O)
+	}
+	upperBounds := make([]expression.Expression, 0, len(pi.Definitions))
+	ranges := make([]expression.Expression, 0, len(pi.Definitions))
+	for i, def := range pi.Definitions {
+		boundStr := buildRangeColumnsUpperBound(cols, def.LessThan)
+		upperExpr, err := expression.ParseSimpleExprWithTableInfo(ctx, boundStr, tblInfo)
+		if err != nil {
+			log.Error("wrong table partition expression:", errors.ErrorStack(err), boundStr)
+			return nil, errors.Trace(err)
+		}
+		upperBounds = append(upperBounds, upperExpr)
+
+		rangeStr := boundStr
+		if i > 0 {
+			prevBoundStr := buildRangeColumnsUpperBound(cols, pi.Definitions[i-1].LessThan)
+			rangeStr = fmt.Sprintf("(not (%s)) and (%s)", prevBoundStr, boundStr)
+		}
+		rangeExpr, err := expression.ParseSimpleExprWithTableInfo(ctx, rangeStr, tblInfo)
+		if err != nil {
+			log.Error("wrong table partition expression:", errors.ErrorStack(err), rangeStr)
+			return nil, errors.Trace(err)
+		}
+		ranges = append(ranges, rangeExpr)
+	}
+	return &PartitionExpr{
+		Ranges:      ranges,
+		UpperBounds: upperBounds,
+	}, nil
+}
+
+// buildRangeColumnsUpperBound builds the row-wise "tuple < bound" expression
+// for a single RANGE COLUMNS partition:
+//   (c1 < b1) or (c1 = b1 and ((c2 < b2) or (c2 = b2 and ...)))
+// A MAXVALUE leg (and, by construction, everything after it) collapses to
+// TRUE, since locatePartition's binary search still only needs this to stay
+// monotonic across partitions, not to be a precise range test.
+func buildRangeColumnsUpperBound(cols []string, bounds []string) string {
+	if len(bounds) == 0 || strings.EqualFold(bounds[0], "MAXVALUE") {
+		return "true"
+	}
+	if len(cols) == 1 {
+		return fmt.Sprintf("((%s) < (%s))", cols[0], bounds[0])
+	}
+	rest := buildRangeColumnsUpperBound(cols[1:], bounds[1:])
+	return fmt.Sprintf("(((%s) < (%s)) or (((%s) = (%s)) and (%s)))", cols[0], bounds[0], cols[0], bounds[0], rest)
+}
+
+// validateRangeColumnsDefinitions enforces the two invariants RANGE COLUMNS
+// relies on: bound tuples must be strictly increasing between partitions,
+// and once a column is MAXVALUE every column after it in that tuple must be
+// MAXVALUE too, since nothing after MAXVALUE can ever be compared against.
+func validateRangeColumnsDefinitions(pi *model.PartitionInfo) error {
+	for _, def := range pi.Definitions {
+		seenMax := false
+		for _, b := range def.LessThan {
+			if strings.EqualFold(b, "MAXVALUE") {
+				seenMax = true
+				continue
+			}
+			if seenMax {
+				return errors.Errorf("partition %q: non-MAXVALUE column follows a MAXVALUE column", def.Name)
+			}
+		}
+	}
+	for i := 1; i < len(pi.Definitions); i++ {
+		cmp, err := compareRangeColumnsBounds(pi.Definitions[i-1].LessThan, pi.Definitions[i].LessThan)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if cmp >= 0 {
+			return errors.Errorf("partition %q: VALUES LESS THAN value must be strictly increasing", pi.Definitions[i].Name)
+		}
+	}
+	return nil
+}
+
+// compareRangeColumnsBounds compares two LessThan tuples column-by-column.
+// MAXVALUE compares greater than any value in the same position; otherwise
+// each literal is evaluated as a constant and compared with the column's
+// natural ordering.
+func compareRangeColumnsBounds(a, b []string) (int, error) {
+	ctx := mock.NewContext()
+	sc := ctx.GetSessionVars().StmtCtx
+	for i := 0; i < len(a) && i < len(b); i++ {
+		aMax := strings.EqualFold(a[i], "MAXVALUE")
+		bMax := strings.EqualFold(b[i], "MAXVALUE")
+		switch {
+		case aMax && bMax:
+			continue
+		case aMax:
+			return 1, nil
+		case bMax:
+			return -1, nil
+		}
+		ad, err := evalConstExprString(ctx, a[i])
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		bd, err := evalConstExprString(ctx, b[i])
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		cmp, err := ad.CompareDatum(sc, &bd)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		if cmp != 0 {
+			return cmp, nil
+		}
+	}
+	return 0, nil
+}
+
+// evalConstExprString parses and evaluates a single constant literal, used
+// when comparing RANGE COLUMNS bounds at DDL-validation time.
+func evalConstExprString(ctx sessionctx.Context, lit string) (types.Datum, error) {
+	expr, err := expression.ParseSimpleExpr(ctx, lit)
+	if err != nil {
+		return types.Datum{}, errors.Trace(err)
+	}
+	return expr.Eval(chunk.MutRowFromDatums(nil).ToRow())
+}
+
+// generateListPartitionExpr builds the LocateExprs/PruneExprs/valueMap used
+// to locate and prune partitions for LIST and LIST COLUMNS tables. For a
+// scalar LIST, pi.Columns is empty and pi.Expr holds the single partitioning
+// expression; for LIST COLUMNS, pi.Columns holds the column list and each
+// value in a partition's InValues is a tuple with one entry per column.
+func generateListPartitionExpr(tblInfo *model.TableInfo, pi *model.PartitionInfo) (*PartitionExpr, error) {
+	ctx := mock.NewContext()
+	colExprStrs := pi.Columns
+	if len(colExprStrs) == 0 {
+		colExprStrs = []model.CIStr{model.NewCIStr(pi.Expr)}
+	}
+	locateExprs := make([]expression.Expression, 0, len(colExprStrs))
+	colNames := make([]string, 0, len(colExprStrs))
+	for _, col := range colExprStrs {
+		expr, err := expression.ParseSimpleExprWithTableInfo(ctx, col.O, tblInfo)
+		if err != nil {
+			log.Error("wrong table partition expression:", errors.ErrorStack(err), col.O)
+			return nil, errors.Trace(err)
+		}
+		locateExprs = append(locateExprs, expr)
+		colNames = append(colNames, col.O)
+	}
+	// The IN-list head must name the same column tuple LocateExprs was just
+	// built from: "(a)" for scalar LIST, "(a, b)" for LIST COLUMNS. Using
+	// pi.Expr unconditionally here is wrong for LIST COLUMNS, where pi.Expr
+	// is empty and the columns live in pi.Columns instead.
+	head := fmt.Sprintf("(%s)", colNames[0])
+	if len(colNames) > 1 {
+		head = fmt.Sprintf("(%s)", strings.Join(colNames, ", "))
+	}
+
+	sc := ctx.GetSessionVars().StmtCtx
+	valueMap := make(map[string]int64)
+	nullPartitionID := int64(-1)
+	pruneExprs := make([]expression.Expression, 0, len(pi.Definitions))
+	var buf bytes.Buffer
+	for _, def := range pi.Definitions {
+		buf.Reset()
+		fmt.Fprintf(&buf, "%s in (", head)
+		for j, tuple := range def.InValues {
+			if j > 0 {
+				buf.WriteString(", ")
+			}
+			if len(tuple) > 1 {
+				buf.WriteString("(" + strings.Join(tuple, ", ") + ")")
+			} else {
+				buf.WriteString(tuple[0])
+			}
+
+			key, isNull, err := encodeListPartitionValue(sc, tuple)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			if isNull {
+				nullPartitionID = def.ID
+				continue
+			}
+			valueMap[key] = def.ID
+		}
+		buf.WriteString(")")
+		expr, err := expression.ParseSimpleExprWithTableInfo(ctx, buf.String(), tblInfo)
+		if err != nil {
+			log.Error("wrong table partition expression:", errors.ErrorStack(err), buf.String())
+			return nil, errors.Trace(err)
+		}
+		pruneExprs = append(pruneExprs, expr)
+	}
+
+	return &PartitionExpr{
+		List: &ForListPruning{
+			LocateExprs:     locateExprs,
+			PruneExprs:      pruneExprs,
+			valueMap:        valueMap,
+			nullPartitionID: nullPartitionID,
+		},
+	}, nil
+}
+
+// encodeListPartitionValue parses and encodes a literal tuple from a LIST
+// partition's IN-list (one literal per partitioning column) into a map key
+// comparable with the encoding produced by evalListPartitionKey. isNull
+// reports whether the tuple is the single-column literal NULL, which is
+// tracked separately since NULL does not participate in equality lookups.
+func encodeListPartitionValue(sc *stmtctx.StatementContext, tuple []string) (key string, isNull bool, err error) {
+	if len(tuple) == 1 && strings.EqualFold(strings.TrimSpace(tuple[0]), "NULL") {
+		return "", true, nil
+	}
+	datums := make([]types.Datum, 0, len(tuple))
+	for _, lit := range tuple {
+		expr, err := expression.ParseSimpleExpr(mock.NewContext(), lit)
+		if err != nil {
+			return "", false, errors.Trace(err)
+		}
+		d, err := expr.Eval(chunk.MutRowFromDatums(nil).ToRow())
+		if err != nil {
+			return "", false, errors.Trace(err)
+		}
+		datums = append(datums, d)
+	}
+	encoded, err := codec.EncodeKey(sc, nil, datums...)
+	if err != nil {
+		return "", false, errors.Trace(err)
+	}
+	return string(encoded), false, nil
+}
+
+// evalListPartitionKey evaluates the LIST / LIST COLUMNS locating
+// expressions against r and encodes the result the same way
+// encodeListPartitionValue does, so the two are directly comparable through
+// ForListPruning.valueMap. isNull must use the same definition of "the NULL
+// case" encodeListPartitionValue does: a bare NULL is only special-cased for
+// scalar LIST (a single partitioning column). LIST COLUMNS tuples may carry
+// NULL in any one column as an ordinary part of the tuple — e.g. (1, NULL)
+// is a ordinary entry in valueMap, not the nullPartitionID case — so a NULL
+// in just one of several columns must still be encoded and looked up
+// normally instead of short-circuiting the whole row to nullPartitionID.
+func evalListPartitionKey(ctx sessionctx.Context, lp *ForListPruning, r []types.Datum) (key string, isNull bool, err error) {
+	row := chunk.MutRowFromDatums(r).ToRow()
+	datums := make([]types.Datum, 0, len(lp.LocateExprs))
+	for _, expr := range lp.LocateExprs {
+		d, err := expr.Eval(row)
+		if err != nil {
+			return "", false, errors.Trace(err)
+		}
+		datums = append(datums, d)
+	}
+	if len(datums) == 1 && datums[0].IsNull() {
+		return "", true, nil
+	}
+	sc := ctx.GetSessionVars().StmtCtx
+	encoded, err := codec.EncodeKey(sc, nil, datums...)
+	if err != nil {
+		return "", false, errors.Trace(err)
+	}
+	return string(encoded), false, nil
+}
+
 // PartitionExpr returns the partition expression.
 func (t *partitionedTable) PartitionExpr() *PartitionExpr {
 	return t.partitionExpr
@@ -158,6 +556,17 @@ func partitionRecordKey(pid int64, handle int64) kv.Key {
 
 // locatePartition returns the partition ID of the input record.
 func (t *partitionedTable) locatePartition(ctx sessionctx.Context, pi *model.PartitionInfo, r []types.Datum) (int64, error) {
+	switch pi.Type {
+	case model.PartitionTypeList:
+		return t.locateListPartition(ctx, r)
+	case model.PartitionTypeHash, model.PartitionTypeKey:
+		return t.locateHashPartition(ctx, pi, r)
+	default:
+		return t.locateRangePartition(ctx, pi, r)
+	}
+}
+
+func (t *partitionedTable) locateRangePartition(ctx sessionctx.Context, pi *model.PartitionInfo, r []types.Datum) (int64, error) {
 	var err error
 	partitionExprs := t.partitionExpr.UpperBounds
 	idx := sort.Search(len(partitionExprs), func(i int) bool {
@@ -178,11 +587,607 @@ func (t *partitionedTable) locatePartition(ctx sessionctx.Context, pi *model.Par
 	return pi.Definitions[idx].ID, nil
 }
 
+// locateListPartition evaluates the LIST/LIST COLUMNS locating expressions
+// once and looks the resulting value up in the partition's valueMap, rather
+// than binary searching, since LIST values have no inherent order.
+func (t *partitionedTable) locateListPartition(ctx sessionctx.Context, r []types.Datum) (int64, error) {
+	lp := t.partitionExpr.List
+	key, isNull, err := evalListPartitionKey(ctx, lp, r)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if isNull {
+		if lp.nullPartitionID == -1 {
+			return 0, errors.Trace(table.ErrNoPartitionForGivenValue)
+		}
+		return lp.nullPartitionID, nil
+	}
+	pid, ok := lp.valueMap[key]
+	if !ok {
+		return 0, errors.Trace(table.ErrNoPartitionForGivenValue)
+	}
+	return pid, nil
+}
+
+// locateHashPartition evaluates the HASH(expr) expression or hashes the
+// KEY(col, ...) columns and mods the result by NumBuckets. Bucket i always
+// maps onto pi.Definitions[i], since newPartitionedTable creates the
+// partitions in that order.
+func (t *partitionedTable) locateHashPartition(ctx sessionctx.Context, pi *model.PartitionInfo, r []types.Datum) (int64, error) {
+	hash := t.partitionExpr.Hash
+	row := chunk.MutRowFromDatums(r).ToRow()
+	var idx int
+	if hash.IsKey {
+		h, err := keyPartitionHash(ctx, hash.KeyColumns, row)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		idx = int(h % uint32(hash.NumBuckets))
+	} else {
+		var err error
+		idx, err = hashExprBucket(ctx, hash, row)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+	}
+	return pi.Definitions[idx].ID, nil
+}
+
+// hashExprBucket evaluates hash.HashExpr against row and returns which
+// bucket (0-based, lining up with pi.Definitions) it falls into. It is
+// shared by locateHashPartition, which evaluates a real row, and
+// PrunePartitions, which evaluates a synthetic row built from a filter's
+// equality constant.
+func hashExprBucket(ctx sessionctx.Context, hash *ForHashPruning, row chunk.Row) (int, error) {
+	v, isNull, err := hash.HashExpr.EvalInt(ctx, row)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if isNull {
+		// MySQL treats NULL as 0 for PARTITION BY HASH.
+		v = 0
+	}
+	// -v overflows back to math.MinInt64 itself in two's complement, so
+	// negating first would leave v negative and index pi.Definitions
+	// out of bounds below. math.MinInt64's bit pattern reinterpreted as
+	// uint64 already equals its true magnitude (2^63), so only that one
+	// value needs special-casing; every other negative v's absolute value
+	// fits in int64 as usual.
+	var mag uint64
+	if v == math.MinInt64 {
+		mag = uint64(v)
+	} else {
+		if v < 0 {
+			v = -v
+		}
+		mag = uint64(v)
+	}
+	return int(mag % uint64(hash.NumBuckets)), nil
+}
+
+// keyPartitionHash hashes the encoded KEY(col, ...) columns, approximating
+// MySQL's documented KEY partitioning hash (an MD5-based function) with a
+// CRC32 checksum over each column's comparable encoding; NULL columns hash
+// as MySQL does, treating NULL as 0.
+func keyPartitionHash(ctx sessionctx.Context, cols []expression.Expression, row chunk.Row) (uint32, error) {
+	sc := ctx.GetSessionVars().StmtCtx
+	h := crc32.NewIEEE()
+	for _, col := range cols {
+		d, err := col.Eval(row)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		if d.IsNull() {
+			d = types.NewIntDatum(0)
+		}
+		encoded, err := codec.EncodeKey(sc, nil, d)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		h.Write(encoded)
+	}
+	return h.Sum32(), nil
+}
+
 // GetPartition returns a Table, which is actually a partition.
 func (t *partitionedTable) GetPartition(pid int64) table.Table {
 	return t.partitions[pid]
 }
 
+// Partitions returns every partition of the table, in partition-definition
+// order, so the planner can iterate survivors of PrunePartitions without
+// reaching into the private partitions map.
+func (t *partitionedTable) Partitions() []table.Table {
+	pi := t.meta.GetPartitionInfo()
+	tbls := make([]table.Table, 0, len(pi.Definitions))
+	for _, def := range pi.Definitions {
+		tbls = append(tbls, t.partitions[def.ID])
+	}
+	return tbls
+}
+
+// PartitionByID returns the partition with the given ID, or nil if id is
+// not one of this table's partitions.
+func (t *partitionedTable) PartitionByID(id int64) table.Table {
+	p, ok := t.partitions[id]
+	if !ok {
+		return nil
+	}
+	return p
+}
+
+// PrunePartitions returns the IDs of the partitions that can possibly
+// satisfy filters. See prunePartitions for how.
+func (t *partitionedTable) PrunePartitions(ctx sessionctx.Context, filters []expression.Expression) ([]int64, error) {
+	return prunePartitions(ctx, t.meta.GetPartitionInfo(), t.partitionExpr, filters)
+}
+
+// prunePartitions is PrunePartitions with pi/pe threaded in explicitly
+// instead of read off a *partitionedTable, the same convention locatePartition
+// and its callees already use, so it can be exercised directly in tests.
+//
+// RANGE and LIST (single-column only; COLUMNS variants fall back to the
+// generic path below) first try a key-constraint check: extractColumnConstraint
+// pulls any simple "col = literal", "col IN (...)", or half-open comparison
+// against the partitioning column out of filters, and that constraint is
+// tested directly against each partition's own bounds/values. Unlike generic
+// constant folding, this correctly proves things like "a > 10 AND a < 5" is
+// unsatisfiable, since it reasons about the column's value range rather than
+// just folding literals. HASH/KEY have no per-partition expression to fold
+// at all, so only HASH(bare column) gets pruned, on equality/IN: hashing
+// each candidate value picks out the one bucket it could land in; KEY and
+// HASH(non-bare-expr) fall all the way back to every partition, since there
+// is no per-partition expression to conjoin filters with in the first
+// place. The COLUMNS variants (RANGE COLUMNS, LIST COLUMNS) do have
+// per-partition expressions, so — unlike KEY — they still run the
+// conjoin-and-fold check below as an honest, weaker fallback, even though
+// they don't reduce to a single comparable key for the fast path above.
+//
+// Every strategy that has per-partition expressions also still runs the
+// original conjoin-and-fold check on top, since it catches contradictions
+// unrelated to the partitioning column that the key-constraint check above
+// doesn't look for.
+func prunePartitions(ctx sessionctx.Context, pi *model.PartitionInfo, pe *PartitionExpr, filters []expression.Expression) ([]int64, error) {
+	if pe.Hash != nil {
+		if pe.Hash.bareColName != "" {
+			kc := extractColumnConstraint(filters, pe.Hash.bareColName)
+			if ids, ok, err := prunePartitionsByHash(ctx, pi, pe.Hash, kc); err != nil {
+				return nil, errors.Trace(err)
+			} else if ok {
+				return ids, nil
+			}
+		}
+		return allPartitionIDs(pi), nil
+	}
+
+	pruneExprs, ok := partitionPruneExprs(pe)
+	if !ok {
+		return allPartitionIDs(pi), nil
+	}
+
+	var kc *keyConstraint
+	if len(pi.Columns) == 0 && pi.Expr != "" {
+		kc = extractColumnConstraint(filters, pi.Expr)
+	}
+
+	sc := ctx.GetSessionVars().StmtCtx
+	survivors := make([]int64, 0, len(pi.Definitions))
+	for i, def := range pi.Definitions {
+		if kc != nil && kc.isSet() {
+			reachable, err := partitionReachable(sc, pi, pe, i, kc)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			if !reachable {
+				continue
+			}
+		}
+
+		conds := make([]expression.Expression, 0, len(filters)+1)
+		conds = append(conds, filters...)
+		conds = append(conds, pruneExprs[i])
+		conj := expression.ComposeCNFCondition(ctx, conds...)
+		if isFalseConstant(ctx, expression.FoldConstant(conj)) {
+			continue
+		}
+		survivors = append(survivors, def.ID)
+	}
+	return survivors, nil
+}
+
+// partitionPruneExprs returns the per-partition expression prunePartitions
+// conjoins with the caller's filters. ok is false when the strategy (HASH,
+// KEY) has no such expression.
+func partitionPruneExprs(pe *PartitionExpr) (exprs []expression.Expression, ok bool) {
+	switch {
+	case pe.List != nil:
+		return pe.List.PruneExprs, true
+	case pe.Ranges != nil:
+		return pe.Ranges, true
+	default:
+		return nil, false
+	}
+}
+
+func allPartitionIDs(pi *model.PartitionInfo) []int64 {
+	ids := make([]int64, 0, len(pi.Definitions))
+	for _, def := range pi.Definitions {
+		ids = append(ids, def.ID)
+	}
+	return ids
+}
+
+// partitionReachable reports whether partition i could hold a row matching
+// kc, testing kc directly against that partition's own values (LIST) or
+// bounds (RANGE) rather than folding an expression.
+func partitionReachable(sc *stmtctx.StatementContext, pi *model.PartitionInfo, pe *PartitionExpr, i int, kc *keyConstraint) (bool, error) {
+	if pe.List != nil {
+		return listPartitionReachable(sc, pi.Definitions[i], kc)
+	}
+	return rangePartitionReachable(sc, pi, i, kc)
+}
+
+// listPartitionReachable checks kc against every scalar value in def's
+// IN-list. Multi-column (LIST COLUMNS) values are skipped, since kc is only
+// ever built for a single partitioning column; a partition that only holds
+// such values is conservatively treated as reachable.
+func listPartitionReachable(sc *stmtctx.StatementContext, def model.PartitionDefinition, kc *keyConstraint) (bool, error) {
+	ctx := mock.NewContext()
+	sawScalar := false
+	for _, tuple := range def.InValues {
+		if len(tuple) != 1 || strings.EqualFold(strings.TrimSpace(tuple[0]), "NULL") {
+			continue
+		}
+		sawScalar = true
+		v, err := evalConstExprString(ctx, tuple[0])
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+		ok, err := kc.allows(sc, v)
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return !sawScalar, nil
+}
+
+// rangePartitionReachable checks kc against partition i's [lower, upper)
+// bound, reconstructed from the same LessThan literals generateRangePartitionExpr
+// parsed Ranges/UpperBounds from.
+func rangePartitionReachable(sc *stmtctx.StatementContext, pi *model.PartitionInfo, i int, kc *keyConstraint) (bool, error) {
+	ctx := mock.NewContext()
+	var lo, hi bound
+	if i > 0 {
+		v, err := evalConstExprString(ctx, pi.Definitions[i-1].LessThan[0])
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+		lo = bound{val: v, exists: true}
+	}
+	if !strings.EqualFold(pi.Definitions[i].LessThan[0], "MAXVALUE") {
+		v, err := evalConstExprString(ctx, pi.Definitions[i].LessThan[0])
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+		hi = bound{val: v, exists: true, open: true}
+	}
+	return kc.overlaps(sc, lo, hi)
+}
+
+// prunePartitionsByHash returns the buckets kc's equality/IN values could
+// hash into. ok is false when kc carries no usable equality values, in which
+// case the caller should fall back to returning every partition: an open
+// range on a hashed column gives no bucket information at all.
+func prunePartitionsByHash(ctx sessionctx.Context, pi *model.PartitionInfo, hash *ForHashPruning, kc *keyConstraint) (ids []int64, ok bool, err error) {
+	if !kc.hasValues {
+		return nil, false, nil
+	}
+	reachable := make(map[int64]bool, len(kc.values))
+	row := make([]types.Datum, hash.rowWidth)
+	for _, v := range kc.values {
+		row[hash.bareColIdx] = v
+		idx, err := hashExprBucket(ctx, hash, chunk.MutRowFromDatums(row).ToRow())
+		if err != nil {
+			return nil, false, errors.Trace(err)
+		}
+		if idx >= 0 && idx < len(pi.Definitions) {
+			reachable[pi.Definitions[idx].ID] = true
+		}
+	}
+	ids = make([]int64, 0, len(reachable))
+	for _, def := range pi.Definitions {
+		if reachable[def.ID] {
+			ids = append(ids, def.ID)
+		}
+	}
+	return ids, true, nil
+}
+
+// keyConstraint is what prunePartitions could determine about the single
+// partitioning column's value from filters: either an explicit set of
+// possible values (from "col = x" / "col IN (...)") or a half-open range
+// (from "col < x", "col <= x", "col > x", "col >= x"). The zero value means
+// filters said nothing usable about the column, which is always safe: it
+// allows every value.
+type keyConstraint struct {
+	hasValues bool
+	values    []types.Datum
+
+	hasLower  bool
+	lower     types.Datum
+	lowerOpen bool
+	hasUpper  bool
+	upper     types.Datum
+	upperOpen bool
+}
+
+func (kc *keyConstraint) isSet() bool {
+	return kc.hasValues || kc.hasLower || kc.hasUpper
+}
+
+func (kc *keyConstraint) addEQ(d types.Datum) {
+	kc.hasValues = true
+	kc.values = append(kc.values, d)
+}
+
+// addCompare folds in a "col <op> lit" (or, if litFirst, "lit <op> col")
+// comparison.
+func (kc *keyConstraint) addCompare(op string, lit types.Datum, litFirst bool) {
+	if litFirst {
+		switch op {
+		case ast.LT:
+			op = ast.GT
+		case ast.LE:
+			op = ast.GE
+		case ast.GT:
+			op = ast.LT
+		case ast.GE:
+			op = ast.LE
+		}
+	}
+	switch op {
+	case ast.GT:
+		kc.hasLower, kc.lower, kc.lowerOpen = true, lit, true
+	case ast.GE:
+		kc.hasLower, kc.lower, kc.lowerOpen = true, lit, false
+	case ast.LT:
+		kc.hasUpper, kc.upper, kc.upperOpen = true, lit, true
+	case ast.LE:
+		kc.hasUpper, kc.upper, kc.upperOpen = true, lit, false
+	}
+}
+
+// allows reports whether v could satisfy kc.
+func (kc *keyConstraint) allows(sc *stmtctx.StatementContext, v types.Datum) (bool, error) {
+	if kc.hasValues {
+		for _, want := range kc.values {
+			cmp, err := v.CompareDatum(sc, &want)
+			if err != nil {
+				return false, errors.Trace(err)
+			}
+			if cmp == 0 {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return boundAllows(sc, bound{val: kc.lower, exists: kc.hasLower, open: kc.lowerOpen},
+		bound{val: kc.upper, exists: kc.hasUpper, open: kc.upperOpen}, v)
+}
+
+// overlaps reports whether some value satisfying kc could also fall in the
+// half-open interval [lo, hi) (either side may be unbounded).
+func (kc *keyConstraint) overlaps(sc *stmtctx.StatementContext, lo, hi bound) (bool, error) {
+	if kc.hasValues {
+		for _, v := range kc.values {
+			ok, err := boundAllows(sc, lo, hi, v)
+			if err != nil {
+				return false, errors.Trace(err)
+			}
+			if ok {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	mergedLo, err := maxLower(sc, bound{val: kc.lower, exists: kc.hasLower, open: kc.lowerOpen}, lo)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	mergedHi, err := minUpper(sc, bound{val: kc.upper, exists: kc.hasUpper, open: kc.upperOpen}, hi)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	empty, err := boundsEmpty(sc, mergedLo, mergedHi)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	return !empty, nil
+}
+
+// bound is one side of a half-open interval test; exists false means
+// unbounded on that side.
+type bound struct {
+	val    types.Datum
+	exists bool
+	open   bool
+}
+
+func boundAllows(sc *stmtctx.StatementContext, lo, hi bound, v types.Datum) (bool, error) {
+	if lo.exists {
+		cmp, err := v.CompareDatum(sc, &lo.val)
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+		if cmp < 0 || (cmp == 0 && lo.open) {
+			return false, nil
+		}
+	}
+	if hi.exists {
+		cmp, err := v.CompareDatum(sc, &hi.val)
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+		if cmp > 0 || (cmp == 0 && hi.open) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func maxLower(sc *stmtctx.StatementContext, a, b bound) (bound, error) {
+	if !a.exists {
+		return b, nil
+	}
+	if !b.exists {
+		return a, nil
+	}
+	cmp, err := a.val.CompareDatum(sc, &b.val)
+	if err != nil {
+		return bound{}, errors.Trace(err)
+	}
+	switch {
+	case cmp > 0:
+		return a, nil
+	case cmp < 0:
+		return b, nil
+	default:
+		return bound{val: a.val, exists: true, open: a.open || b.open}, nil
+	}
+}
+
+func minUpper(sc *stmtctx.StatementContext, a, b bound) (bound, error) {
+	if !a.exists {
+		return b, nil
+	}
+	if !b.exists {
+		return a, nil
+	}
+	cmp, err := a.val.CompareDatum(sc, &b.val)
+	if err != nil {
+		return bound{}, errors.Trace(err)
+	}
+	switch {
+	case cmp < 0:
+		return a, nil
+	case cmp > 0:
+		return b, nil
+	default:
+		return bound{val: a.val, exists: true, open: a.open || b.open}, nil
+	}
+}
+
+func boundsEmpty(sc *stmtctx.StatementContext, lo, hi bound) (bool, error) {
+	if !lo.exists || !hi.exists {
+		return false, nil
+	}
+	cmp, err := lo.val.CompareDatum(sc, &hi.val)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	if cmp > 0 {
+		return true, nil
+	}
+	if cmp == 0 && (lo.open || hi.open) {
+		return true, nil
+	}
+	return false, nil
+}
+
+// extractColumnConstraint scans filters for simple comparisons against the
+// column named colName (case-insensitive) and folds them into a
+// keyConstraint the caller can test partitions against directly, without
+// needing the ranger-style range builder this tree doesn't have. Filters
+// that don't reduce to a simple "col <cmp> literal" shape are ignored, which
+// only costs pruning opportunities, never correctness.
+func extractColumnConstraint(filters []expression.Expression, colExpr string) *keyConstraint {
+	kc := &keyConstraint{}
+	colName := strings.ToLower(strings.TrimSpace(colExpr))
+
+	var walk func(expr expression.Expression)
+	walk = func(expr expression.Expression) {
+		sf, ok := expr.(*expression.ScalarFunction)
+		if !ok {
+			return
+		}
+		args := sf.GetArgs()
+		switch sf.FuncName.L {
+		case ast.LogicAnd:
+			for _, arg := range args {
+				walk(arg)
+			}
+		case ast.EQ, ast.LT, ast.LE, ast.GT, ast.GE:
+			if len(args) != 2 {
+				return
+			}
+			col, con, litFirst := matchColumnConstant(args, colName)
+			if col == nil {
+				return
+			}
+			if sf.FuncName.L == ast.EQ {
+				kc.addEQ(con.Value)
+			} else {
+				kc.addCompare(sf.FuncName.L, con.Value, litFirst)
+			}
+		case ast.In:
+			if len(args) < 2 {
+				return
+			}
+			col, ok := args[0].(*expression.Column)
+			if !ok || col.ColName.L != colName {
+				return
+			}
+			for _, a := range args[1:] {
+				if con, ok := a.(*expression.Constant); ok {
+					kc.addEQ(con.Value)
+				}
+			}
+		}
+	}
+	for _, f := range filters {
+		walk(f)
+	}
+	return kc
+}
+
+// matchColumnConstant recognizes a binary "col <op> literal" (or
+// "literal <op> col") scalar function's arguments, returning the matched
+// column, the constant, and whether the literal came first.
+func matchColumnConstant(args []expression.Expression, colName string) (*expression.Column, *expression.Constant, bool) {
+	if c, ok := args[0].(*expression.Column); ok && c.ColName.L == colName {
+		if k, ok := args[1].(*expression.Constant); ok {
+			return c, k, false
+		}
+	}
+	if c, ok := args[1].(*expression.Column); ok && c.ColName.L == colName {
+		if k, ok := args[0].(*expression.Constant); ok {
+			return c, k, true
+		}
+	}
+	return nil, nil, false
+}
+
+// isFalseConstant reports whether a folded expression is the constant
+// false, i.e. the partition it was built from is provably unreachable.
+func isFalseConstant(ctx sessionctx.Context, expr expression.Expression) bool {
+	con, ok := expr.(*expression.Constant)
+	if !ok {
+		return false
+	}
+	if con.Value.IsNull() {
+		return false
+	}
+	sc := ctx.GetSessionVars().StmtCtx
+	b, err := con.Value.ToBool(sc)
+	if err != nil {
+		return false
+	}
+	return b == 0
+}
+
 // AddRecord implements the AddRecord method for the table.Table interface.
 func (t *partitionedTable) AddRecord(ctx sessionctx.Context, r []types.Datum, skipHandleCheck bool) (recordID int64, err error) {
 	partitionInfo := t.meta.GetPartitionInfo()
@@ -224,28 +1229,63 @@ func (t *partitionedTable) UpdateRecord(ctx sessionctx.Context, h int64, currDat
 	// The old and new data locate in different partitions.
 	// Remove record from old partition and add record to new partition.
 	if from != to {
-		_, err = t.GetPartition(to).AddRecord(ctx, newData, false)
-		if err != nil {
-			return errors.Trace(err)
-		}
-		// UpdateRecord should be side effect free, but there're two steps here.
-		// What would happen if step1 succeed but step2 meets error? It's hard
-		// to rollback.
-		// So this special order is chosen: add record first, errors such as
-		// 'Key Already Exists' will generally happen during step1, errors are
-		// unlikely to happen in step2.
-		err = t.GetPartition(from).RemoveRecord(ctx, h, currData)
-		if err != nil {
-			log.Error("partition update record error, it may write dirty data to txn:", errors.ErrorStack(err))
-			return errors.Trace(err)
-		}
-		return nil
+		return t.updateRecordCrossPartition(ctx, from, to, h, currData, newData)
 	}
 
 	tbl := t.GetPartition(to)
 	return tbl.UpdateRecord(ctx, h, currData, newData, touched)
 }
 
+// updateRecordCrossPartition moves a row from partition `from` to partition
+// `to`. Both the AddRecord into `to` and the RemoveRecord from `from` are
+// staged against the same kv transaction membuffer before either becomes
+// visible: if anything fails after staging, the whole savepoint is
+// discarded and neither partition is touched, instead of the old
+// add-then-delete sequence that could leave the table corrupted if the
+// delete failed after the add had already committed.
+//
+// AddRecord into `to` runs first, so a unique-index conflict in the
+// destination partition is surfaced before the source row's removal is ever
+// staged, leaving the original row untouched.
+func (t *partitionedTable) updateRecordCrossPartition(ctx sessionctx.Context, from, to, h int64, currData, newData []types.Datum) error {
+	txn, err := ctx.Txn(true)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return stageCrossPartitionMove(txn.GetMemBuffer(),
+		func() error { _, err := t.GetPartition(to).AddRecord(ctx, newData, false); return err },
+		func() error { return t.GetPartition(from).RemoveRecord(ctx, h, currData) },
+	)
+}
+
+// stagingBuffer is the slice of kv.MemBuffer's savepoint API
+// stageCrossPartitionMove needs; kv.MemBuffer satisfies it. Pulling it out
+// as its own interface lets the staging/rollback behavior be unit tested
+// against a fake buffer, without needing a real kv transaction.
+type stagingBuffer interface {
+	Staging() kv.StagingHandle
+	Release(kv.StagingHandle)
+	Cleanup(kv.StagingHandle)
+}
+
+// stageCrossPartitionMove runs add then remove under the same membuffer
+// savepoint, discarding the savepoint (and so neither mutation) if either
+// step fails, and releasing it only once both have succeeded.
+func stageCrossPartitionMove(buf stagingBuffer, add, remove func() error) error {
+	sh := buf.Staging()
+	defer buf.Cleanup(sh)
+
+	if err := add(); err != nil {
+		return errors.Trace(err)
+	}
+	if err := remove(); err != nil {
+		return errors.Trace(err)
+	}
+
+	buf.Release(sh)
+	return nil
+}
+
 func (t *partitionedTable) GetID() int64 {
 	panic("GetID() should never be called on PartitionedTable")
 }
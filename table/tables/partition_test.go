@@ -0,0 +1,504 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tables
+
+import (
+	"math"
+	"testing"
+
+	"github.com/juju/errors"
+	. "github.com/pingcap/check"
+	"github.com/pingcap/tidb/expression"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/model"
+	"github.com/pingcap/tidb/mysql"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/chunk"
+	"github.com/pingcap/tidb/util/mock"
+)
+
+func TestT(t *testing.T) {
+	TestingT(t)
+}
+
+type testPartitionSuite struct{}
+
+var _ = Suite(&testPartitionSuite{})
+
+type partitionTestCol struct {
+	name string
+	tp   byte
+}
+
+// buildPartitionTestTableInfo builds the minimal model.TableInfo
+// generatePartitionExpr needs to resolve column names in pi.Expr/pi.Columns.
+func buildPartitionTestTableInfo(cols []partitionTestCol, pi *model.PartitionInfo) *model.TableInfo {
+	tblInfo := &model.TableInfo{
+		ID:        1,
+		Name:      model.NewCIStr("t"),
+		Partition: pi,
+	}
+	for i, col := range cols {
+		ft := types.NewFieldType(col.tp)
+		tblInfo.Columns = append(tblInfo.Columns, &model.ColumnInfo{
+			ID:        int64(i + 1),
+			Name:      model.NewCIStr(col.name),
+			Offset:    i,
+			FieldType: *ft,
+			State:     model.StatePublic,
+		})
+	}
+	return tblInfo
+}
+
+func (s *testPartitionSuite) TestListPartitionInt(c *C) {
+	pi := &model.PartitionInfo{
+		Type: model.PartitionTypeList,
+		Expr: "a",
+		Definitions: []model.PartitionDefinition{
+			{ID: 1, Name: model.NewCIStr("p0"), InValues: [][]string{{"1"}, {"2"}}},
+			{ID: 2, Name: model.NewCIStr("p1"), InValues: [][]string{{"3"}, {"4"}}},
+		},
+	}
+	tblInfo := buildPartitionTestTableInfo([]partitionTestCol{{"a", mysql.TypeLong}}, pi)
+	pe, err := generatePartitionExpr(tblInfo)
+	c.Assert(err, IsNil)
+	c.Assert(pe.List, NotNil)
+
+	t := &partitionedTable{partitionExpr: pe}
+	ctx := mock.NewContext()
+
+	id, err := t.locatePartition(ctx, pi, types.MakeDatums(3))
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, int64(2))
+
+	_, err = t.locatePartition(ctx, pi, types.MakeDatums(99))
+	c.Assert(err, NotNil)
+}
+
+func (s *testPartitionSuite) TestListPartitionString(c *C) {
+	pi := &model.PartitionInfo{
+		Type: model.PartitionTypeList,
+		Expr: "a",
+		Definitions: []model.PartitionDefinition{
+			{ID: 1, Name: model.NewCIStr("p0"), InValues: [][]string{{"'a'"}, {"'b'"}}},
+			{ID: 2, Name: model.NewCIStr("p1"), InValues: [][]string{{"'c'"}}},
+		},
+	}
+	tblInfo := buildPartitionTestTableInfo([]partitionTestCol{{"a", mysql.TypeVarchar}}, pi)
+	pe, err := generatePartitionExpr(tblInfo)
+	c.Assert(err, IsNil)
+
+	t := &partitionedTable{partitionExpr: pe}
+	ctx := mock.NewContext()
+
+	id, err := t.locatePartition(ctx, pi, types.MakeDatums("c"))
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, int64(2))
+}
+
+func (s *testPartitionSuite) TestListColumnsPartitionMultiColumnAndNull(c *C) {
+	pi := &model.PartitionInfo{
+		Type:    model.PartitionTypeList,
+		Columns: []model.CIStr{model.NewCIStr("a"), model.NewCIStr("b")},
+		Definitions: []model.PartitionDefinition{
+			{ID: 1, Name: model.NewCIStr("p0"), InValues: [][]string{{"1", "'x'"}, {"1", "NULL"}}},
+			{ID: 2, Name: model.NewCIStr("p1"), InValues: [][]string{{"2", "'y'"}}},
+		},
+	}
+	tblInfo := buildPartitionTestTableInfo([]partitionTestCol{{"a", mysql.TypeLong}, {"b", mysql.TypeVarchar}}, pi)
+	pe, err := generatePartitionExpr(tblInfo)
+	c.Assert(err, IsNil)
+
+	t := &partitionedTable{partitionExpr: pe}
+	ctx := mock.NewContext()
+
+	id, err := t.locatePartition(ctx, pi, types.MakeDatums(1, "x"))
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, int64(1))
+
+	// (1, NULL) is an ordinary tuple value in p0's IN-list, not the
+	// "whole-row NULL" case, since this table has more than one
+	// partitioning column.
+	id, err = t.locatePartition(ctx, pi, types.MakeDatums(1, nil))
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, int64(1))
+
+	_, err = t.locatePartition(ctx, pi, types.MakeDatums(2, nil))
+	c.Assert(err, NotNil)
+}
+
+func (s *testPartitionSuite) TestListColumnsPartitionPruneExprsRowConstructor(c *C) {
+	pi := &model.PartitionInfo{
+		Type:    model.PartitionTypeList,
+		Columns: []model.CIStr{model.NewCIStr("a"), model.NewCIStr("b")},
+		Definitions: []model.PartitionDefinition{
+			{ID: 1, Name: model.NewCIStr("p0"), InValues: [][]string{{"1", "'x'"}, {"2", "'y'"}}},
+		},
+	}
+	tblInfo := buildPartitionTestTableInfo([]partitionTestCol{{"a", mysql.TypeLong}, {"b", mysql.TypeVarchar}}, pi)
+	pe, err := generatePartitionExpr(tblInfo)
+	c.Assert(err, IsNil)
+	ctx := mock.NewContext()
+
+	// Each tuple in a multi-column LIST COLUMNS IN-list must be its own
+	// row-constructor, "(a, b) in ((1,'x'), (2,'y'))", not the flattened
+	// scalar list "(a, b) in (1, 'x', 2, 'y')" — the latter parses to a
+	// different predicate that mismatches tuples across columns, e.g. it
+	// would wrongly accept (1, 'y').
+	matching, _, err := pe.List.PruneExprs[0].EvalInt(ctx, chunk.MutRowFromDatums(types.MakeDatums(1, "x")).ToRow())
+	c.Assert(err, IsNil)
+	c.Assert(matching, Equals, int64(1))
+
+	mismatched, _, err := pe.List.PruneExprs[0].EvalInt(ctx, chunk.MutRowFromDatums(types.MakeDatums(1, "y")).ToRow())
+	c.Assert(err, IsNil)
+	c.Assert(mismatched, Equals, int64(0))
+}
+
+func (s *testPartitionSuite) TestListPartitionScalarNull(c *C) {
+	pi := &model.PartitionInfo{
+		Type: model.PartitionTypeList,
+		Expr: "a",
+		Definitions: []model.PartitionDefinition{
+			{ID: 1, Name: model.NewCIStr("p0"), InValues: [][]string{{"1"}, {"NULL"}}},
+			{ID: 2, Name: model.NewCIStr("p1"), InValues: [][]string{{"2"}}},
+		},
+	}
+	tblInfo := buildPartitionTestTableInfo([]partitionTestCol{{"a", mysql.TypeLong}}, pi)
+	pe, err := generatePartitionExpr(tblInfo)
+	c.Assert(err, IsNil)
+
+	t := &partitionedTable{partitionExpr: pe}
+	ctx := mock.NewContext()
+
+	id, err := t.locatePartition(ctx, pi, types.MakeDatums(nil))
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, int64(1))
+}
+
+func (s *testPartitionSuite) buildHashTestTable() (*partitionedTable, *model.PartitionInfo) {
+	pi := &model.PartitionInfo{
+		Type: model.PartitionTypeHash,
+		Expr: "a",
+		Definitions: []model.PartitionDefinition{
+			{ID: 1, Name: model.NewCIStr("p0")},
+			{ID: 2, Name: model.NewCIStr("p1")},
+			{ID: 3, Name: model.NewCIStr("p2")},
+		},
+	}
+	tblInfo := buildPartitionTestTableInfo([]partitionTestCol{{"a", mysql.TypeLong}}, pi)
+	pe, err := generatePartitionExpr(tblInfo)
+	if err != nil {
+		panic(err)
+	}
+	return &partitionedTable{partitionExpr: pe}, pi
+}
+
+func (s *testPartitionSuite) TestHashPartitionNegativeValue(c *C) {
+	t, pi := s.buildHashTestTable()
+	ctx := mock.NewContext()
+
+	posID, err := t.locatePartition(ctx, pi, types.MakeDatums(7))
+	c.Assert(err, IsNil)
+	negID, err := t.locatePartition(ctx, pi, types.MakeDatums(-7))
+	c.Assert(err, IsNil)
+	c.Assert(negID, Equals, posID)
+}
+
+func (s *testPartitionSuite) TestHashPartitionMinInt64DoesNotPanic(c *C) {
+	t, pi := s.buildHashTestTable()
+	ctx := mock.NewContext()
+
+	// Negating math.MinInt64 overflows back to itself in two's complement;
+	// locatePartition must still land on a valid bucket instead of indexing
+	// pi.Definitions with a negative idx.
+	id, err := t.locatePartition(ctx, pi, types.MakeDatums(int64(math.MinInt64)))
+	c.Assert(err, IsNil)
+	c.Assert(id >= pi.Definitions[0].ID && id <= pi.Definitions[len(pi.Definitions)-1].ID, IsTrue)
+}
+
+func (s *testPartitionSuite) TestHashPartitionNull(c *C) {
+	t, pi := s.buildHashTestTable()
+	ctx := mock.NewContext()
+
+	// MySQL treats NULL as 0 for PARTITION BY HASH.
+	nullID, err := t.locatePartition(ctx, pi, types.MakeDatums(nil))
+	c.Assert(err, IsNil)
+	zeroID, err := t.locatePartition(ctx, pi, types.MakeDatums(0))
+	c.Assert(err, IsNil)
+	c.Assert(nullID, Equals, zeroID)
+}
+
+func (s *testPartitionSuite) TestHashPartitionUnevenDistribution(c *C) {
+	t, pi := s.buildHashTestTable()
+	ctx := mock.NewContext()
+
+	seen := make(map[int64]bool)
+	for i := 0; i < 10; i++ {
+		id, err := t.locatePartition(ctx, pi, types.MakeDatums(i))
+		c.Assert(err, IsNil)
+		c.Assert(id >= pi.Definitions[0].ID && id <= pi.Definitions[len(pi.Definitions)-1].ID, IsTrue)
+		seen[id] = true
+	}
+	// 10 values over 3 buckets can't split evenly, but every bucket should
+	// still be reachable.
+	c.Assert(len(seen), Equals, 3)
+}
+
+func buildPruneTestFilter(c *C, tblInfo *model.TableInfo, expr string) []expression.Expression {
+	f, err := expression.ParseSimpleExprWithTableInfo(mock.NewContext(), expr, tblInfo)
+	c.Assert(err, IsNil)
+	return []expression.Expression{f}
+}
+
+func (s *testPartitionSuite) TestPrunePartitionsRangeEquality(c *C) {
+	pi := &model.PartitionInfo{
+		Type: model.PartitionTypeRange,
+		Expr: "a",
+		Definitions: []model.PartitionDefinition{
+			{ID: 1, Name: model.NewCIStr("p0"), LessThan: []string{"10"}},
+			{ID: 2, Name: model.NewCIStr("p1"), LessThan: []string{"20"}},
+			{ID: 3, Name: model.NewCIStr("p2"), LessThan: []string{"MAXVALUE"}},
+		},
+	}
+	tblInfo := buildPartitionTestTableInfo([]partitionTestCol{{"a", mysql.TypeLong}}, pi)
+	pe, err := generatePartitionExpr(tblInfo)
+	c.Assert(err, IsNil)
+	ctx := mock.NewContext()
+
+	ids, err := prunePartitions(ctx, pi, pe, buildPruneTestFilter(c, tblInfo, "a = 15"))
+	c.Assert(err, IsNil)
+	c.Assert(ids, DeepEquals, []int64{2})
+
+	ids, err = prunePartitions(ctx, pi, pe, buildPruneTestFilter(c, tblInfo, "a in (5, 25)"))
+	c.Assert(err, IsNil)
+	c.Assert(ids, DeepEquals, []int64{1, 3})
+}
+
+func (s *testPartitionSuite) TestPrunePartitionsRangeHalfOpenContradiction(c *C) {
+	pi := &model.PartitionInfo{
+		Type: model.PartitionTypeRange,
+		Expr: "a",
+		Definitions: []model.PartitionDefinition{
+			{ID: 1, Name: model.NewCIStr("p0"), LessThan: []string{"10"}},
+			{ID: 2, Name: model.NewCIStr("p1"), LessThan: []string{"20"}},
+			{ID: 3, Name: model.NewCIStr("p2"), LessThan: []string{"MAXVALUE"}},
+		},
+	}
+	tblInfo := buildPartitionTestTableInfo([]partitionTestCol{{"a", mysql.TypeLong}}, pi)
+	pe, err := generatePartitionExpr(tblInfo)
+	c.Assert(err, IsNil)
+	ctx := mock.NewContext()
+
+	// "a > 10 and a < 5" is unsatisfiable, but plain constant folding can't
+	// tell that by itself; prunePartitions must still rule out every
+	// partition via the key-constraint check.
+	filters := []expression.Expression{
+		buildPruneTestFilter(c, tblInfo, "a > 10")[0],
+		buildPruneTestFilter(c, tblInfo, "a < 5")[0],
+	}
+	ids, err := prunePartitions(ctx, pi, pe, filters)
+	c.Assert(err, IsNil)
+	c.Assert(ids, HasLen, 0)
+
+	// A satisfiable half-open range only survives the partitions it spans.
+	filters = []expression.Expression{
+		buildPruneTestFilter(c, tblInfo, "a >= 10")[0],
+		buildPruneTestFilter(c, tblInfo, "a < 20")[0],
+	}
+	ids, err = prunePartitions(ctx, pi, pe, filters)
+	c.Assert(err, IsNil)
+	c.Assert(ids, DeepEquals, []int64{2})
+}
+
+func (s *testPartitionSuite) TestPrunePartitionsListEquality(c *C) {
+	pi := &model.PartitionInfo{
+		Type: model.PartitionTypeList,
+		Expr: "a",
+		Definitions: []model.PartitionDefinition{
+			{ID: 1, Name: model.NewCIStr("p0"), InValues: [][]string{{"1"}, {"2"}}},
+			{ID: 2, Name: model.NewCIStr("p1"), InValues: [][]string{{"3"}, {"4"}}},
+		},
+	}
+	tblInfo := buildPartitionTestTableInfo([]partitionTestCol{{"a", mysql.TypeLong}}, pi)
+	pe, err := generatePartitionExpr(tblInfo)
+	c.Assert(err, IsNil)
+	ctx := mock.NewContext()
+
+	ids, err := prunePartitions(ctx, pi, pe, buildPruneTestFilter(c, tblInfo, "a = 3"))
+	c.Assert(err, IsNil)
+	c.Assert(ids, DeepEquals, []int64{2})
+
+	ids, err = prunePartitions(ctx, pi, pe, buildPruneTestFilter(c, tblInfo, "a in (1, 4)"))
+	c.Assert(err, IsNil)
+	c.Assert(ids, DeepEquals, []int64{1, 2})
+}
+
+func (s *testPartitionSuite) TestPrunePartitionsHashEquality(c *C) {
+	pi := &model.PartitionInfo{
+		Type: model.PartitionTypeHash,
+		Expr: "a",
+		Definitions: []model.PartitionDefinition{
+			{ID: 1, Name: model.NewCIStr("p0")},
+			{ID: 2, Name: model.NewCIStr("p1")},
+			{ID: 3, Name: model.NewCIStr("p2")},
+		},
+	}
+	tblInfo := buildPartitionTestTableInfo([]partitionTestCol{{"a", mysql.TypeLong}}, pi)
+	pe, err := generatePartitionExpr(tblInfo)
+	c.Assert(err, IsNil)
+	t := &partitionedTable{partitionExpr: pe}
+	ctx := mock.NewContext()
+
+	wantID, err := t.locatePartition(ctx, pi, types.MakeDatums(7))
+	c.Assert(err, IsNil)
+
+	ids, err := prunePartitions(ctx, pi, pe, buildPruneTestFilter(c, tblInfo, "a = 7"))
+	c.Assert(err, IsNil)
+	c.Assert(ids, DeepEquals, []int64{wantID})
+
+	// An IN-list can span more than one bucket.
+	otherID, err := t.locatePartition(ctx, pi, types.MakeDatums(8))
+	c.Assert(err, IsNil)
+	ids, err = prunePartitions(ctx, pi, pe, buildPruneTestFilter(c, tblInfo, "a in (7, 8)"))
+	c.Assert(err, IsNil)
+	if wantID == otherID {
+		c.Assert(ids, DeepEquals, []int64{wantID})
+	} else {
+		c.Assert(len(ids) == 2, IsTrue)
+	}
+
+	// HASH with no equality filter can't be narrowed; every partition
+	// survives.
+	ids, err = prunePartitions(ctx, pi, pe, buildPruneTestFilter(c, tblInfo, "a > 0"))
+	c.Assert(err, IsNil)
+	c.Assert(ids, DeepEquals, allPartitionIDs(pi))
+}
+
+func (s *testPartitionSuite) TestKeyPartitionIsDeterministic(c *C) {
+	pi := &model.PartitionInfo{
+		Type:    model.PartitionTypeKey,
+		Columns: []model.CIStr{model.NewCIStr("a")},
+		Definitions: []model.PartitionDefinition{
+			{ID: 1, Name: model.NewCIStr("p0")},
+			{ID: 2, Name: model.NewCIStr("p1")},
+		},
+	}
+	tblInfo := buildPartitionTestTableInfo([]partitionTestCol{{"a", mysql.TypeLong}}, pi)
+	pe, err := generatePartitionExpr(tblInfo)
+	c.Assert(err, IsNil)
+
+	t := &partitionedTable{partitionExpr: pe}
+	ctx := mock.NewContext()
+
+	id1, err := t.locatePartition(ctx, pi, types.MakeDatums(42))
+	c.Assert(err, IsNil)
+	id2, err := t.locatePartition(ctx, pi, types.MakeDatums(42))
+	c.Assert(err, IsNil)
+	c.Assert(id1, Equals, id2)
+}
+
+// fakeStagingBuffer is a minimal stagingBuffer fake that records which
+// savepoint calls stageCrossPartitionMove makes, without needing a real kv
+// transaction or MemBuffer.
+type fakeStagingBuffer struct {
+	stagedCount  int
+	released     bool
+	cleanedCount int
+}
+
+func (f *fakeStagingBuffer) Staging() kv.StagingHandle {
+	f.stagedCount++
+	return kv.StagingHandle(f.stagedCount)
+}
+
+func (f *fakeStagingBuffer) Release(h kv.StagingHandle) {
+	f.released = true
+}
+
+func (f *fakeStagingBuffer) Cleanup(h kv.StagingHandle) {
+	f.cleanedCount++
+}
+
+func (s *testPartitionSuite) TestCrossPartitionMoveRollsBackOnAddError(c *C) {
+	buf := &fakeStagingBuffer{}
+	removeCalled := false
+
+	err := stageCrossPartitionMove(buf,
+		func() error { return errors.New("duplicate key") },
+		func() error { removeCalled = true; return nil },
+	)
+
+	c.Assert(err, NotNil)
+	c.Assert(removeCalled, IsFalse) // the add failed, so remove must never run
+	c.Assert(buf.released, IsFalse) // the savepoint must never be released
+	c.Assert(buf.cleanedCount, Equals, 1)
+}
+
+func (s *testPartitionSuite) TestCrossPartitionMoveRollsBackOnRemoveError(c *C) {
+	buf := &fakeStagingBuffer{}
+	addCalled := false
+
+	err := stageCrossPartitionMove(buf,
+		func() error { addCalled = true; return nil },
+		func() error { return errors.New("kv write conflict") },
+	)
+
+	c.Assert(err, NotNil)
+	c.Assert(addCalled, IsTrue)
+	c.Assert(buf.released, IsFalse) // the staged add must be discarded too
+	c.Assert(buf.cleanedCount, Equals, 1)
+}
+
+func (s *testPartitionSuite) TestCrossPartitionMoveCommitsOnSuccess(c *C) {
+	buf := &fakeStagingBuffer{}
+
+	err := stageCrossPartitionMove(buf,
+		func() error { return nil },
+		func() error { return nil },
+	)
+
+	c.Assert(err, IsNil)
+	c.Assert(buf.released, IsTrue)
+}
+
+// TestCrossPartitionMoveRealMemBufferRollback exercises stageCrossPartitionMove
+// against a real kv.MemBuffer instead of fakeStagingBuffer, so the rollback
+// is verified at the data level: after a failure injected between the
+// staged add and the remove, the destination row the add staged must be
+// gone and the source row must be bitwise unchanged.
+func (s *testPartitionSuite) TestCrossPartitionMoveRealMemBufferRollback(c *C) {
+	ctx := mock.NewContext()
+	txn, err := ctx.Txn(true)
+	c.Assert(err, IsNil)
+	buf := txn.GetMemBuffer()
+
+	srcKey := kv.Key("t_src_row")
+	destKey := kv.Key("t_dest_row")
+	srcVal := []byte("original-row-bytes")
+	c.Assert(buf.Set(srcKey, srcVal), IsNil)
+
+	err = stageCrossPartitionMove(buf,
+		func() error { return buf.Set(destKey, []byte("new-row-bytes")) },
+		func() error { return errors.New("kv write conflict") },
+	)
+	c.Assert(err, NotNil)
+
+	_, getErr := buf.Get(destKey)
+	c.Assert(getErr, NotNil) // the staged destination row must have been rolled back
+
+	got, err := buf.Get(srcKey)
+	c.Assert(err, IsNil)
+	c.Assert(got, DeepEquals, srcVal) // the untouched source row must be bitwise unchanged
+}